@@ -0,0 +1,269 @@
+package gitdiff
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"sort"
+	"time"
+
+	"code.gitea.io/gitea/modules/base"
+	"code.gitea.io/gitea/modules/charset"
+	"code.gitea.io/gitea/modules/git"
+	"code.gitea.io/gitea/modules/log"
+	"code.gitea.io/gitea/modules/setting"
+	stdcharset "golang.org/x/net/html/charset"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/transform"
+)
+
+// ErrUseBuiltinDiff is returned by GetDiff when no external backend could be
+// used, so the caller should fall back to the built-in unified-diff parser.
+var ErrUseBuiltinDiff = errors.New("gitdiff: no external diff backend available, use the built-in parser")
+
+// DiffBackend is an external (or otherwise alternative) diff engine that can
+// be used instead of Gitea's built-in unified-diff parser. Implementations
+// are expected to shell out to a binary that understands git's diff
+// invocation and emit one JSON object per line on stdout.
+type DiffBackend interface {
+	// Name is the identifier used in configuration and DiffOptions.Backend.
+	Name() string
+	// Available reports whether the backend's binary can be located and run
+	// in the current environment.
+	Available(ctx context.Context) bool
+	// Run executes the backend against gitRepo for the given opts and files,
+	// returning a parsed Diff.
+	Run(gitRepo *git.Repository, opts *DiffOptions, files ...string) (*Diff, error)
+}
+
+var diffBackends = map[string]DiffBackend{}
+
+// RegisterDiffBackend makes a DiffBackend available for selection by name.
+// It is expected to be called from package init functions.
+func RegisterDiffBackend(b DiffBackend) {
+	diffBackends[b.Name()] = b
+}
+
+// DiffBackendNames returns the names of all registered backends, sorted.
+func DiffBackendNames() []string {
+	names := make([]string, 0, len(diffBackends))
+	for name := range diffBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectDiffBackend resolves the backend requested for opts, falling back to
+// the instance-wide default configured in setting.Git.Diff.DefaultBackend.
+func selectDiffBackend(opts *DiffOptions) (DiffBackend, bool) {
+	name := opts.Backend
+	if name == "" {
+		name = setting.Git.Diff.DefaultBackend
+	}
+	if name == "" {
+		return nil, false
+	}
+	b, ok := diffBackends[name]
+	return b, ok
+}
+
+// GetDiff runs the diff backend selected by opts (or the configured default)
+// and returns the parsed result. If no backend is selected or the selected
+// name is not registered, it returns ErrUseBuiltinDiff without logging; if the
+// backend is unavailable or fails to run, it logs the reason and returns
+// ErrUseBuiltinDiff. Either way callers fall back to the built-in unified-diff
+// parser instead of failing outright.
+func GetDiff(gitRepo *git.Repository, opts *DiffOptions, files ...string) (*Diff, error) {
+	backend, ok := selectDiffBackend(opts)
+	if !ok {
+		return nil, ErrUseBuiltinDiff
+	}
+
+	if !backend.Available(gitRepo.Ctx) {
+		log.Warn("gitdiff: backend %q requested but not available, falling back to built-in diff", backend.Name())
+		return nil, ErrUseBuiltinDiff
+	}
+
+	diff, err := backend.Run(gitRepo, opts, files...)
+	if err != nil {
+		err = fmt.Errorf("%s: %w", backend.Name(), err)
+		log.Error("gitdiff: backend failed, falling back to built-in diff: %v", err)
+		return nil, ErrUseBuiltinDiff
+	}
+
+	return diff, nil
+}
+
+// classifyDiffFileStatus maps a backend's file-status token to Gitea's
+// DiffFileType. Both mydt and difft are expected to emit one of these.
+func classifyDiffFileStatus(status string) DiffFileType {
+	switch status {
+	case "created", "added":
+		return DiffFileAdd
+	case "deleted", "removed":
+		return DiffFileDel
+	case "renamed":
+		return DiffFileRename
+	case "copied":
+		return DiffFileCopy
+	default:
+		return DiffFileChange
+	}
+}
+
+// renameDetectionArgs turns a 0-100 similarity threshold into the -M/-C
+// flags that enable git's rename and copy detection at that confidence. A
+// score of 0 or less passes a bare -M, which keeps git's own default rename
+// threshold and leaves copy detection off.
+func renameDetectionArgs(score int) []string {
+	if score <= 0 {
+		return []string{"-M"}
+	}
+	return []string{fmt.Sprintf("-M%d%%", score), fmt.Sprintf("-C%d%%", score)}
+}
+
+// lookPathAvailable reports whether name can be found on PATH. It is the
+// standard Available implementation for backends that shell out to a binary.
+func lookPathAvailable(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// jsonDiffParser parses the line-delimited JSON a backend writes to stdout
+// into a Diff.
+type jsonDiffParser func(maxLines, maxLineCharacters, maxFiles int, reader io.Reader, skipToFile string) (*Diff, error)
+
+// runJSONDiffBackend builds the standard empty-tree / two-commit / --skip-to
+// git diff invocation shared by all line-delimited-JSON backends, pipes its
+// stdout through parse, and logs stderr on failure. extraArgs are the
+// backend-specific arguments inserted right after "git" (e.g. the name of an
+// external tool, or "diff" plus backend-specific flags); env are additional
+// environment variables the backend needs (e.g. to select JSON output).
+func runJSONDiffBackend(gitRepo *git.Repository, opts *DiffOptions, extraArgs, env []string, parse jsonDiffParser, files ...string) (*Diff, error) {
+	repoPath := gitRepo.Path
+
+	commit, err := gitRepo.GetCommit(opts.AfterCommitID)
+	if err != nil {
+		return nil, err
+	}
+
+	cmdDiff := git.NewCommand(gitRepo.Ctx)
+	if (len(opts.BeforeCommitID) == 0 || opts.BeforeCommitID == git.EmptySHA) && commit.ParentCount() == 0 {
+		cmdDiff.AddArguments(extraArgs...).
+			AddArguments(opts.WhitespaceBehavior...).
+			AddArguments("4b825dc642cb6eb9a060e54bf8d69288fbee4904"). // append empty tree ref
+			AddDynamicArguments(opts.AfterCommitID)
+	} else {
+		actualBeforeCommitID := opts.BeforeCommitID
+		if len(actualBeforeCommitID) == 0 {
+			parentCommit, _ := commit.Parent(0)
+			actualBeforeCommitID = parentCommit.ID.String()
+		}
+
+		cmdDiff.AddArguments(extraArgs...).
+			AddArguments(opts.WhitespaceBehavior...).
+			AddDynamicArguments(actualBeforeCommitID, opts.AfterCommitID)
+		opts.BeforeCommitID = actualBeforeCommitID
+	}
+
+	// In git 2.31, git diff learned --skip-to which we can use to shortcut skip to file
+	// so if we are using at least this version of git we don't have to tell ParsePatch to do
+	// the skipping for us
+	parsePatchSkipToFile := opts.SkipTo
+	if opts.SkipTo != "" && git.CheckGitVersionAtLeast("2.31") == nil {
+		cmdDiff.AddOptionFormat("--skip-to=%s", opts.SkipTo)
+		parsePatchSkipToFile = ""
+	}
+
+	cmdDiff.AddDashesAndList(files...)
+
+	reader, writer := io.Pipe()
+	defer func() {
+		_ = reader.Close()
+		_ = writer.Close()
+	}()
+
+	go func() {
+		stderr := &bytes.Buffer{}
+		cmdDiff.SetDescription(fmt.Sprintf("GetDiffRange [repo_path: %s]", repoPath))
+		if err := cmdDiff.Run(&git.RunOpts{
+			Env:     append([]string{"PATH=" + os.Getenv("PATH")}, env...),
+			Timeout: time.Duration(setting.Git.Timeout.Default) * time.Second,
+			Dir:     repoPath,
+			Stdout:  writer,
+			Stderr:  stderr,
+		}); err != nil {
+			log.Error("error during GetDiff(git diff dir: %s): %v, stderr: %s", repoPath, err, stderr.String())
+		}
+
+		_ = writer.Close()
+	}()
+
+	return parse(opts.MaxLines, opts.MaxLineCharacters, opts.MaxFiles, reader, parsePatchSkipToFile)
+}
+
+// newJSONLineScanner returns a buffered reader sized to comfortably hold a
+// single JSON line, at least maxLineCharacters or 4096 bytes, whichever is
+// larger.
+func newJSONLineScanner(reader io.Reader, maxLineCharacters int) *bufio.Reader {
+	readerSize := maxLineCharacters
+	if readerSize < 4096 {
+		readerSize = 4096
+	}
+	return bufio.NewReaderSize(reader, readerSize)
+}
+
+// decodeDiffFileLines re-detects the encoding of each line type (plain, add,
+// del) across a file's content and, where it differs from UTF-8, re-decodes
+// the line content in place. This is a best-effort fix-up: backends emit
+// per-line JSON with no byte-order-mark or encoding hint, so there isn't
+// enough context to detect encoding more precisely than per-file.
+func decodeDiffFileLines(f *DiffFile) {
+	f.NameHash = base.EncodeSha1(f.Name)
+
+	diffLineTypeBuffers := map[DiffLineType]*bytes.Buffer{
+		DiffLinePlain: new(bytes.Buffer),
+		DiffLineAdd:   new(bytes.Buffer),
+		DiffLineDel:   new(bytes.Buffer),
+	}
+	for _, sec := range f.Sections {
+		for _, l := range sec.Lines {
+			buffer, ok := diffLineTypeBuffers[l.Type]
+			if !ok {
+				continue
+			}
+			buffer.WriteString(l.Content[1:])
+			buffer.WriteString("\n")
+		}
+	}
+
+	diffLineTypeDecoders := make(map[DiffLineType]*encoding.Decoder, len(diffLineTypeBuffers))
+	for lineType, buffer := range diffLineTypeBuffers {
+		if buffer.Len() == 0 {
+			continue
+		}
+		charsetLabel, err := charset.DetectEncoding(buffer.Bytes())
+		if charsetLabel != "UTF-8" && err == nil {
+			if enc, _ := stdcharset.Lookup(charsetLabel); enc != nil {
+				diffLineTypeDecoders[lineType] = enc.NewDecoder()
+			}
+		}
+	}
+
+	for _, sec := range f.Sections {
+		for _, l := range sec.Lines {
+			decoder := diffLineTypeDecoders[l.Type]
+			if decoder != nil {
+				if c, _, err := transform.String(decoder, l.Content[1:]); err == nil {
+					l.Content = l.Content[0:1] + c
+				}
+			}
+		}
+	}
+}
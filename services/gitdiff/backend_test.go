@@ -0,0 +1,25 @@
+package gitdiff
+
+import "testing"
+
+func TestClassifyDiffFileStatus(t *testing.T) {
+	tests := []struct {
+		status string
+		want   DiffFileType
+	}{
+		{"created", DiffFileAdd},
+		{"added", DiffFileAdd},
+		{"deleted", DiffFileDel},
+		{"removed", DiffFileDel},
+		{"renamed", DiffFileRename},
+		{"copied", DiffFileCopy},
+		{"modified", DiffFileChange},
+		{"", DiffFileChange},
+		{"unknown", DiffFileChange},
+	}
+	for _, tt := range tests {
+		if got := classifyDiffFileStatus(tt.status); got != tt.want {
+			t.Errorf("classifyDiffFileStatus(%q) = %v, want %v", tt.status, got, tt.want)
+		}
+	}
+}
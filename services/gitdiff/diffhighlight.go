@@ -0,0 +1,80 @@
+package gitdiff
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"sync"
+
+	"github.com/sergi/go-diff/diffmatchpatch"
+)
+
+var (
+	diffMatchPatchOnce sync.Once
+	diffMatchPatch     *diffmatchpatch.DiffMatchPatch
+)
+
+func getDiffMatchPatch() *diffmatchpatch.DiffMatchPatch {
+	diffMatchPatchOnce.Do(func() {
+		diffMatchPatch = diffmatchpatch.New()
+		diffMatchPatch.DiffEditCost = 100
+	})
+	return diffMatchPatch
+}
+
+// ComputedInlineDiffFor returns word-level highlighted HTML for an add/del
+// line that has a paired opposite-type line in the same section (see the
+// Match field, populated during parsing). Lines without a pair, or that
+// aren't adds/dels, are returned as plain escaped content.
+func (sec *DiffSection) ComputedInlineDiffFor(diffLine *DiffLine) template.HTML {
+	if diffLine.Type != DiffLineAdd && diffLine.Type != DiffLineDel {
+		return template.HTML(html.EscapeString(diffLine.Content))
+	}
+	if diffLine.Match == -1 || diffLine.Match >= len(sec.Lines) {
+		return template.HTML(html.EscapeString(diffLine.Content))
+	}
+
+	paired := sec.Lines[diffLine.Match]
+	delLine, addLine := diffLine, paired
+	if diffLine.Type == DiffLineAdd {
+		delLine, addLine = paired, diffLine
+	}
+
+	dmp := getDiffMatchPatch()
+	diffs := dmp.DiffMain(delLine.Content[1:], addLine.Content[1:], true)
+	diffs = dmp.DiffCleanupEfficiency(diffs)
+
+	return diffLineHighlightHTML(diffs, diffLine.Type)
+}
+
+func diffLineHighlightHTML(diffs []diffmatchpatch.Diff, lineType DiffLineType) template.HTML {
+	buf := bytes.Buffer{}
+	if lineType == DiffLineAdd {
+		buf.WriteString("+")
+	} else {
+		buf.WriteString("-")
+	}
+
+	for _, diff := range diffs {
+		switch diff.Type {
+		case diffmatchpatch.DiffEqual:
+			buf.WriteString(html.EscapeString(diff.Text))
+		case diffmatchpatch.DiffInsert:
+			if lineType != DiffLineAdd {
+				continue
+			}
+			buf.WriteString(`<span class="added-code">`)
+			buf.WriteString(html.EscapeString(diff.Text))
+			buf.WriteString(`</span>`)
+		case diffmatchpatch.DiffDelete:
+			if lineType != DiffLineDel {
+				continue
+			}
+			buf.WriteString(`<span class="removed-code">`)
+			buf.WriteString(html.EscapeString(diff.Text))
+			buf.WriteString(`</span>`)
+		}
+	}
+
+	return template.HTML(buf.String())
+}
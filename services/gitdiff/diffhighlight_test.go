@@ -0,0 +1,39 @@
+package gitdiff
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestComputedInlineDiffForHighlightsPairedLines(t *testing.T) {
+	sec := &DiffSection{}
+	delLine := &DiffLine{Type: DiffLineDel, Content: "-hello world", Match: -1}
+	addLine := &DiffLine{Type: DiffLineAdd, Content: "+hello there", Match: -1}
+	sec.Lines = append(sec.Lines, delLine, addLine)
+	delLine.Match = 1
+	addLine.Match = 0
+
+	delHTML := string(sec.ComputedInlineDiffFor(delLine))
+	addHTML := string(sec.ComputedInlineDiffFor(addLine))
+
+	if !strings.Contains(delHTML, `removed-code`) {
+		t.Fatalf("expected del line HTML to contain a removed-code span, got %q", delHTML)
+	}
+	if !strings.Contains(addHTML, `added-code`) {
+		t.Fatalf("expected add line HTML to contain an added-code span, got %q", addHTML)
+	}
+}
+
+func TestComputedInlineDiffForUnpairedLineReturnsPlain(t *testing.T) {
+	sec := &DiffSection{}
+	plain := &DiffLine{Type: DiffLineDel, Content: "-hello world", Match: -1}
+	sec.Lines = append(sec.Lines, plain)
+
+	html := string(sec.ComputedInlineDiffFor(plain))
+	if strings.Contains(html, "<span") {
+		t.Fatalf("expected unpaired line to render without highlight spans, got %q", html)
+	}
+	if html != "-hello world" {
+		t.Fatalf("expected unpaired line to render as escaped plain content, got %q", html)
+	}
+}
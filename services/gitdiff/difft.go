@@ -1,27 +1,25 @@
 package gitdiff
 
 import (
-	"bufio"
-	"bytes"
+	"context"
 	"fmt"
 	"io"
-	"time"
+	"strings"
 
-	"code.gitea.io/gitea/modules/base"
-	"code.gitea.io/gitea/modules/charset"
 	"code.gitea.io/gitea/modules/git"
 	"code.gitea.io/gitea/modules/json"
 	"code.gitea.io/gitea/modules/log"
-	"code.gitea.io/gitea/modules/setting"
-	stdcharset "golang.org/x/net/html/charset"
-	"golang.org/x/text/encoding"
-	"golang.org/x/text/transform"
 )
 
+func init() {
+	RegisterDiffBackend(difftBackend{})
+}
+
 type DifftChange struct {
-	Start   uint32 `json:"start"`
-	End     uint32 `json:"end"`
-	Content string `json:"content"`
+	Start     uint32 `json:"start"`
+	End       uint32 `json:"end"`
+	Content   string `json:"content"`
+	Highlight string `json:"highlight"` // "normal" for unchanged context within the line, anything else marks a structural edit
 }
 
 type DifftSide struct {
@@ -37,108 +35,118 @@ type DifftLine struct {
 type DifftHunk []DifftLine
 
 type DifftFile struct {
-	Path     string      `json:"path"`
-	Language string      `json:"language"`
-	Status   string      `json:"status"`
-	Chunks   []DifftHunk `json:"chunks"`
+	Path       string      `json:"path"`
+	OldPath    string      `json:"old_path,omitempty"`
+	Language   string      `json:"language"`
+	Status     string      `json:"status"` // "created", "deleted", "renamed", or "modified"
+	Similarity int         `json:"similarity,omitempty"`
+	OldBlobSHA string      `json:"old_blob_sha,omitempty"`
+	NewBlobSHA string      `json:"new_blob_sha,omitempty"`
+	Chunks     []DifftHunk `json:"chunks"`
 }
 
-func getDifft(gitRepo *git.Repository, opts *DiffOptions, files ...string) (*Diff, error) {
-	repoPath := gitRepo.Path
+// difftBackend is the DiffBackend implementation that drives git via
+// GIT_EXTERNAL_DIFF=difft and parses difftastic's line-delimited JSON output.
+type difftBackend struct{}
+
+func (difftBackend) Name() string { return "difft" }
 
-	commit, err := gitRepo.GetCommit(opts.AfterCommitID)
+func (difftBackend) Available(ctx context.Context) bool {
+	return lookPathAvailable("difft")
+}
+
+func (difftBackend) Run(gitRepo *git.Repository, opts *DiffOptions, files ...string) (*Diff, error) {
+	extraArgs := append([]string{"diff", "--src-prefix=\\a/", "--dst-prefix=\\b/"}, renameDetectionArgs(opts.RenameDetectionScore)...)
+	env := []string{
+		"DFT_UNSTABLE=yes",
+		"DFT_DISPLAY=json",
+		"GIT_EXTERNAL_DIFF=difft",
+	}
+	diff, err := runJSONDiffBackend(gitRepo, opts, extraArgs, env, parseDifftPatch, files...)
 	if err != nil {
 		return nil, err
 	}
+	return diff, nil
+}
 
-	cmdDiff := git.NewCommand(gitRepo.Ctx)
-	if (len(opts.BeforeCommitID) == 0 || opts.BeforeCommitID == git.EmptySHA) && commit.ParentCount() == 0 {
-		cmdDiff.AddArguments("diff", "--src-prefix=\\a/", "--dst-prefix=\\b/", "-M").
-			AddArguments(opts.WhitespaceBehavior...).
-			AddArguments("4b825dc642cb6eb9a060e54bf8d69288fbee4904"). // append empty tree ref
-			AddDynamicArguments(opts.AfterCommitID)
-	} else {
-		actualBeforeCommitID := opts.BeforeCommitID
-		if len(actualBeforeCommitID) == 0 {
-			parentCommit, _ := commit.Parent(0)
-			actualBeforeCommitID = parentCommit.ID.String()
+// allFragmentsNormal reports whether every fragment on one side of a
+// DifftLine is unchanged context, i.e. none of them mark a structural edit.
+func allFragmentsNormal(changes []DifftChange) bool {
+	for _, dc := range changes {
+		if !strings.EqualFold(dc.Highlight, "normal") {
+			return false
 		}
+	}
+	return true
+}
 
-		cmdDiff.AddArguments("diff", "--src-prefix=\\a/", "--dst-prefix=\\b/", "-M").
-			AddArguments(opts.WhitespaceBehavior...).
-			AddDynamicArguments(actualBeforeCommitID, opts.AfterCommitID)
-		opts.BeforeCommitID = actualBeforeCommitID
+// buildDifftLineContent concatenates one side's change fragments into the
+// full line text (prefixed with sign) and records each fragment's offsets as
+// a DiffTokenRange, so structural edits reported by difftastic survive as
+// token-level highlights instead of being collapsed into a whole-line change.
+// maxLineCharacters of -1 means unlimited; otherwise content (excluding
+// sign) longer than that is truncated and truncated is reported as true.
+func buildDifftLineContent(sign string, changes []DifftChange, maxLineCharacters int) (content string, ranges []DiffTokenRange, truncated bool) {
+	sb := strings.Builder{}
+	sb.WriteString(sign)
+	ranges = make([]DiffTokenRange, 0, len(changes))
+	for _, dc := range changes {
+		kind := DiffTokenRangeContext
+		if !strings.EqualFold(dc.Highlight, "normal") {
+			kind = DiffTokenRangeChanged
+		}
+		ranges = append(ranges, DiffTokenRange{Start: dc.Start, End: dc.End, Kind: kind})
+		sb.WriteString(dc.Content)
 	}
 
-	// In git 2.31, git diff learned --skip-to which we can use to shortcut skip to file
-	// so if we are using at least this version of git we don't have to tell ParsePatch to do
-	// the skipping for us
-	parsePatchSkipToFile := opts.SkipTo
-	if opts.SkipTo != "" && git.CheckGitVersionAtLeast("2.31") == nil {
-		cmdDiff.AddOptionFormat("--skip-to=%s", opts.SkipTo)
-		parsePatchSkipToFile = ""
+	content = sb.String()
+	if maxLineCharacters > -1 && len(content)-len(sign) > maxLineCharacters {
+		content = content[:len(sign)+maxLineCharacters]
+		truncated = true
+		ranges = clampDiffTokenRanges(ranges, uint32(maxLineCharacters))
 	}
+	return content, ranges, truncated
+}
 
-	cmdDiff.AddDashesAndList(files...)
-
-	reader, writer := io.Pipe()
-	defer func() {
-		_ = reader.Close()
-		_ = writer.Close()
-	}()
-
-	go func() {
-		stderr := &bytes.Buffer{}
-		cmdDiff.SetDescription(fmt.Sprintf("GetDiffRange [repo_path: %s]", repoPath))
-		if err := cmdDiff.Run(&git.RunOpts{
-			Env: []string{
-				"DFT_UNSTABLE=yes",
-				"DFT_DISPLAY=json",
-				"GIT_EXTERNAL_DIFF=difft",
-			},
-			Timeout: time.Duration(setting.Git.Timeout.Default) * time.Second,
-			Dir:     repoPath,
-			Stdout:  writer,
-			Stderr:  stderr,
-		}); err != nil {
-			log.Error("error during GetDiff(git diff dir: %s): %v, stderr: %s", repoPath, err, stderr.String())
+// clampDiffTokenRanges drops or shortens ranges so none of them extend past
+// a line body truncated to limit bytes - otherwise RangeHighlightHTML's own
+// bounds check silently discards an out-of-range entry and everything after
+// it, turning a truncated structural edit back into plain context.
+func clampDiffTokenRanges(ranges []DiffTokenRange, limit uint32) []DiffTokenRange {
+	clamped := make([]DiffTokenRange, 0, len(ranges))
+	for _, r := range ranges {
+		if r.Start >= limit {
+			break
 		}
-
-		_ = writer.Close()
-	}()
-
-	diff, err := parseDifftPatch(opts.MaxLines, opts.MaxLineCharacters, opts.MaxFiles, reader, parsePatchSkipToFile)
-	if err != nil {
-		return nil, fmt.Errorf("unable to parseDifftPatch: %w", err)
+		if r.End > limit {
+			r.End = limit
+		}
+		clamped = append(clamped, r)
 	}
-
-	return diff, nil
+	return clamped
 }
 
-// ParsePatch builds a Diff object from a io.Reader and some parameters.
+// parseDifftPatch builds a Diff object from difftastic's line-delimited JSON
+// output and some parameters.
 func parseDifftPatch(maxLines, maxLineCharacters, maxFiles int, reader io.Reader, skipToFile string) (*Diff, error) {
 	log.Debug("parseDifftPatch(%d, %d, %d, ..., %s)", maxLines, maxLineCharacters, maxFiles, skipToFile)
 
 	skipping := skipToFile != ""
 
 	diff := &Diff{Files: make([]*DiffFile, 0)}
-	// sb := strings.Builder{}
 
-	// OK let's set a reasonable buffer size.
-	// This should be at least the size of maxLineCharacters or 4096 whichever is larger.
-	readerSize := maxLineCharacters
-	if readerSize < 4096 {
-		readerSize = 4096
-	}
+	input := newJSONLineScanner(reader, maxLineCharacters)
 
-	input := bufio.NewReaderSize(reader, readerSize)
+	// lineCount is the running total of DifftLines parsed across all files,
+	// checked against maxLines so a single huge file can't bypass it.
+	lineCount := 0
 
-	// parsingLoop:
+parsingLoop:
 	for {
 		line, err := input.ReadBytes('\n')
 		if err != nil {
 			if err == io.EOF {
-				return diff, nil
+				break parsingLoop
 			}
 			return diff, err
 		}
@@ -152,65 +160,131 @@ func parseDifftPatch(maxLines, maxLineCharacters, maxFiles int, reader io.Reader
 		curFile := &DiffFile{
 			Name:     file.Path,
 			Index:    len(diff.Files) + 1,
-			Type:     DiffFileChange,
+			Type:     classifyDiffFileStatus(file.Status),
 			Sections: make([]*DiffSection, 0, 10),
 		}
-
-		// if maxFiles > -1 && len(diff.Files) >= maxFiles {
-		// 	// 		lastFile := createDiffFile(diff, line)
-		// 	// 		diff.End = lastFile.Name
-		// 	// 		diff.IsIncomplete = true
-		// 	// 		_, err := io.Copy(io.Discard, reader)
-		// 	// 		if err != nil {
-		// 	// 			// By the definition of io.Copy this never returns io.EOF
-		// 	// 			return diff, fmt.Errorf("error during io.Copy: %w", err)
-		// 	// 		}
-		// 	break parsingLoop
-		// }
+		if curFile.Type == DiffFileRename || curFile.Type == DiffFileCopy {
+			curFile.OldName = file.OldPath
+			curFile.RenameScore = file.Similarity
+		}
+		curFile.OldBlobSHA = file.OldBlobSHA
+		curFile.NewBlobSHA = file.NewBlobSHA
+
+		if maxFiles > -1 && len(diff.Files) >= maxFiles {
+			diff.IsIncomplete = true
+			diff.End = curFile.Name
+			if _, err := io.Copy(io.Discard, reader); err != nil {
+				// By the definition of io.Copy this never returns io.EOF
+				return diff, fmt.Errorf("error during io.Copy: %w", err)
+			}
+			break parsingLoop
+		}
 
 		if skipping {
 			if curFile.Name != skipToFile {
-				// line, err = skipToNextDiffHead(input)
-				// if err != nil {
-				// 	if err == io.EOF {
-				// 		return diff, nil
-				// 	}
-				// 	return diff, err
-				// }
 				continue
 			}
 			skipping = false
 		}
 		diff.Files = append(diff.Files, curFile)
 
+		fileLineLimitHit := false
 		for _, chunk := range file.Chunks {
+			if fileLineLimitHit {
+				break
+			}
 			curSection := &DiffSection{
 				file:     curFile,
 				FileName: curFile.Name,
 			}
+			// difft has no textual hunk header to source hunk sizes from, so
+			// derive them by counting the chunk's lines that have changes on
+			// each side (unchanged context lines count on both sides) - callers
+			// expanding context need these to know where the next hunk begins.
+			var leftHunkSize, rightHunkSize int
+			for _, l := range chunk {
+				if len(l.Lhs.Changes) > 0 {
+					leftHunkSize++
+				}
+				if len(l.Rhs.Changes) > 0 {
+					rightHunkSize++
+				}
+			}
 			curSection.Lines = append(curSection.Lines, &DiffLine{
-				Type:        DiffLineSection,
-				Content:     "@",
-				SectionInfo: nil,
+				Type:    DiffLineSection,
+				Content: "@",
+				SectionInfo: &DiffLineSectionInfo{
+					LeftHunkSize:  leftHunkSize,
+					RightHunkSize: rightHunkSize,
+				},
 			})
 			for _, line := range chunk {
-				for _, dc := range line.Lhs.Changes {
+				if maxLines > -1 && lineCount >= maxLines {
+					curFile.IsIncomplete = true
+					fileLineLimitHit = true
+					break
+				}
+
+				// difftastic reports unchanged context lines as a Lhs/Rhs pair
+				// whose fragments are all Highlight == "normal" on both sides;
+				// only lines with an actual structural edit need the del/add
+				// pairing below, otherwise context gets miscounted as churn.
+				if len(line.Lhs.Changes) > 0 && len(line.Rhs.Changes) > 0 &&
+					allFragmentsNormal(line.Lhs.Changes) && allFragmentsNormal(line.Rhs.Changes) {
+					content, ranges, truncated := buildDifftLineContent(" ", line.Lhs.Changes, maxLineCharacters)
+					curSection.Lines = append(curSection.Lines, &DiffLine{
+						Type:         DiffLinePlain,
+						Content:      content,
+						Ranges:       ranges,
+						LeftIdx:      int(line.Lhs.LineNumber),
+						RightIdx:     int(line.Rhs.LineNumber),
+						Match:        -1,
+						IsIncomplete: truncated,
+					})
+					lineCount++
+					continue
+				}
+
+				// Each side's Changes are fragments of one logical line; collapse
+				// them into a single linked del/add pair instead of one DiffLine
+				// per fragment, so the two sides can be shown side-by-side.
+				// lineCount is bumped once per *DiffLine actually appended (one
+				// for a del-only or add-only line, two for a del+add pair), to
+				// stay in lockstep with the 1:1 accounting in parseSpecialPatch.
+				delIdx, addIdx := -1, -1
+				if len(line.Lhs.Changes) > 0 {
+					content, ranges, truncated := buildDifftLineContent("-", line.Lhs.Changes, maxLineCharacters)
 					diffLine := &DiffLine{
-						Type:        DiffLineDel,
-						Content:     "-" + dc.Content,
-						SectionInfo: nil,
+						Type:         DiffLineDel,
+						Content:      content,
+						Ranges:       ranges,
+						LeftIdx:      int(line.Lhs.LineNumber),
+						Match:        -1,
+						IsIncomplete: truncated,
 					}
 					curSection.Lines = append(curSection.Lines, diffLine)
+					delIdx = len(curSection.Lines) - 1
 					curFile.Deletion++
+					lineCount++
 				}
-				for _, dc := range line.Rhs.Changes {
+				if len(line.Rhs.Changes) > 0 {
+					content, ranges, truncated := buildDifftLineContent("+", line.Rhs.Changes, maxLineCharacters)
 					diffLine := &DiffLine{
-						Type:        DiffLineAdd,
-						Content:     "+" + dc.Content,
-						SectionInfo: nil,
+						Type:         DiffLineAdd,
+						Content:      content,
+						Ranges:       ranges,
+						RightIdx:     int(line.Rhs.LineNumber),
+						Match:        -1,
+						IsIncomplete: truncated,
 					}
 					curSection.Lines = append(curSection.Lines, diffLine)
+					addIdx = len(curSection.Lines) - 1
 					curFile.Addition++
+					lineCount++
+				}
+				if delIdx != -1 && addIdx != -1 {
+					curSection.Lines[delIdx].Match = addIdx
+					curSection.Lines[addIdx].Match = delIdx
 				}
 			}
 			curFile.Sections = append(curFile.Sections, curSection)
@@ -223,49 +297,8 @@ func parseDifftPatch(maxLines, maxLineCharacters, maxFiles int, reader io.Reader
 	// TODO: There are numerous issues with this:
 	// - we might want to consider detecting encoding while parsing but...
 	// - we're likely to fail to get the correct encoding here anyway as we won't have enough information
-	diffLineTypeBuffers := make(map[DiffLineType]*bytes.Buffer, 3)
-	diffLineTypeDecoders := make(map[DiffLineType]*encoding.Decoder, 3)
-	diffLineTypeBuffers[DiffLinePlain] = new(bytes.Buffer)
-	diffLineTypeBuffers[DiffLineAdd] = new(bytes.Buffer)
-	diffLineTypeBuffers[DiffLineDel] = new(bytes.Buffer)
 	for _, f := range diff.Files {
-		f.NameHash = base.EncodeSha1(f.Name)
-
-		for _, buffer := range diffLineTypeBuffers {
-			buffer.Reset()
-		}
-		for _, sec := range f.Sections {
-			for _, l := range sec.Lines {
-				if l.Type == DiffLineSection {
-					continue
-				}
-				diffLineTypeBuffers[l.Type].WriteString(l.Content[1:])
-				diffLineTypeBuffers[l.Type].WriteString("\n")
-			}
-		}
-		for lineType, buffer := range diffLineTypeBuffers {
-			diffLineTypeDecoders[lineType] = nil
-			if buffer.Len() == 0 {
-				continue
-			}
-			charsetLabel, err := charset.DetectEncoding(buffer.Bytes())
-			if charsetLabel != "UTF-8" && err == nil {
-				encoding, _ := stdcharset.Lookup(charsetLabel)
-				if encoding != nil {
-					diffLineTypeDecoders[lineType] = encoding.NewDecoder()
-				}
-			}
-		}
-		for _, sec := range f.Sections {
-			for _, l := range sec.Lines {
-				decoder := diffLineTypeDecoders[l.Type]
-				if decoder != nil {
-					if c, _, err := transform.String(decoder, l.Content[1:]); err == nil {
-						l.Content = l.Content[0:1] + c
-					}
-				}
-			}
-		}
+		decodeDiffFileLines(f)
 	}
 
 	diff.NumFiles = len(diff.Files)
@@ -0,0 +1,78 @@
+package gitdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func TestParseDifftPatchClassifiesUnchangedContextAsPlain(t *testing.T) {
+	chunk := DifftHunk{
+		{
+			Lhs: DifftSide{LineNumber: 1, Changes: []DifftChange{{Start: 0, End: 7, Content: "context", Highlight: "normal"}}},
+			Rhs: DifftSide{LineNumber: 1, Changes: []DifftChange{{Start: 0, End: 7, Content: "context", Highlight: "normal"}}},
+		},
+		{
+			Lhs: DifftSide{LineNumber: 2, Changes: []DifftChange{{Start: 0, End: 3, Content: "old", Highlight: "novel"}}},
+			Rhs: DifftSide{LineNumber: 2, Changes: []DifftChange{{Start: 0, End: 3, Content: "new", Highlight: "novel"}}},
+		},
+	}
+	file := DifftFile{Path: "file.txt", Status: "modified", Chunks: []DifftHunk{chunk}}
+	b, err := json.Marshal(file)
+	if err != nil {
+		t.Fatalf("marshal synthetic file: %v", err)
+	}
+	b = append(b, '\n')
+
+	diff, err := parseDifftPatch(-1, -1, -1, bytes.NewReader(b), "")
+	if err != nil {
+		t.Fatalf("parseDifftPatch: %v", err)
+	}
+
+	var lines []*DiffLine
+	for _, sec := range diff.Files[0].Sections {
+		for _, l := range sec.Lines {
+			if l.Type != DiffLineSection {
+				lines = append(lines, l)
+			}
+		}
+	}
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 content lines (1 plain + 1 del + 1 add), got %d", len(lines))
+	}
+	if lines[0].Type != DiffLinePlain {
+		t.Fatalf("expected unchanged context line to be DiffLinePlain, got %v", lines[0].Type)
+	}
+	if lines[1].Type != DiffLineDel || lines[2].Type != DiffLineAdd {
+		t.Fatalf("expected del/add pair for the structural edit, got %v/%v", lines[1].Type, lines[2].Type)
+	}
+
+	if diff.Files[0].Addition != 1 || diff.Files[0].Deletion != 1 {
+		t.Fatalf("expected 1 addition and 1 deletion, got +%d/-%d", diff.Files[0].Addition, diff.Files[0].Deletion)
+	}
+}
+
+func TestBuildDifftLineContentClampsRangesWhenTruncated(t *testing.T) {
+	changes := []DifftChange{
+		{Start: 0, End: 5, Content: "hello", Highlight: "normal"},
+		{Start: 5, End: 10, Content: "world", Highlight: "novel"},
+	}
+
+	content, ranges, truncated := buildDifftLineContent("+", changes, 7)
+
+	if !truncated {
+		t.Fatalf("expected content to be reported as truncated")
+	}
+	bodyLen := uint32(len(content) - 1)
+	for _, r := range ranges {
+		if r.Start > bodyLen || r.End > bodyLen {
+			t.Fatalf("expected range %+v to be clamped to truncated body length %d", r, bodyLen)
+		}
+	}
+	if len(ranges) != 2 {
+		t.Fatalf("expected both ranges to survive clamping (second shortened), got %d", len(ranges))
+	}
+	if ranges[1].End != bodyLen {
+		t.Fatalf("expected second range's End to be clamped to %d, got %d", bodyLen, ranges[1].End)
+	}
+}
@@ -0,0 +1,75 @@
+package gitdiff
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+)
+
+// DiffTokenRangeKind classifies a DiffTokenRange as either surrounding
+// context or a structurally changed token, mirroring the distinction
+// difftastic draws within a single line.
+type DiffTokenRangeKind int
+
+const (
+	DiffTokenRangeContext DiffTokenRangeKind = iota
+	DiffTokenRangeChanged
+)
+
+// DiffTokenRange marks a byte range within a DiffLine's Content (excluding
+// the leading +/- sign) that a structural diff backend identified as either
+// context or changed, so it can be rendered without re-deriving it from a
+// textual diff.
+type DiffTokenRange struct {
+	Start uint32
+	End   uint32
+	Kind  DiffTokenRangeKind
+}
+
+// RangeHighlightHTML renders dl.Content using its explicit Ranges, producing
+// the same added-code/removed-code markup as ComputedInlineDiffFor but
+// without recomputing a diff - the backend already told us which tokens
+// changed. Falls back to plain escaped content when there are no ranges.
+func (dl *DiffLine) RangeHighlightHTML() template.HTML {
+	if len(dl.Ranges) == 0 || len(dl.Content) == 0 {
+		return template.HTML(html.EscapeString(dl.Content))
+	}
+
+	sign := dl.Content[0:1]
+	body := dl.Content[1:]
+	bodyLen := uint32(len(body))
+
+	spanClass := "added-code"
+	if dl.Type == DiffLineDel {
+		spanClass = "removed-code"
+	}
+
+	buf := bytes.Buffer{}
+	buf.WriteString(sign)
+
+	var cursor uint32
+	for _, r := range dl.Ranges {
+		if r.Start > bodyLen || r.End > bodyLen || r.End < r.Start || r.Start < cursor {
+			continue
+		}
+		if r.Start > cursor {
+			buf.WriteString(html.EscapeString(body[cursor:r.Start]))
+		}
+		segment := body[r.Start:r.End]
+		if r.Kind == DiffTokenRangeChanged {
+			buf.WriteString(`<span class="`)
+			buf.WriteString(spanClass)
+			buf.WriteString(`">`)
+			buf.WriteString(html.EscapeString(segment))
+			buf.WriteString(`</span>`)
+		} else {
+			buf.WriteString(html.EscapeString(segment))
+		}
+		cursor = r.End
+	}
+	if cursor < bodyLen {
+		buf.WriteString(html.EscapeString(body[cursor:]))
+	}
+
+	return template.HTML(buf.String())
+}
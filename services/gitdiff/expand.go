@@ -0,0 +1,78 @@
+package gitdiff
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"code.gitea.io/gitea/modules/git"
+)
+
+// DiffLineExpandDirection describes which side of a collapsed hunk boundary
+// a context-expansion request should reveal.
+type DiffLineExpandDirection int
+
+const (
+	DiffLineExpandUp DiffLineExpandDirection = iota
+	DiffLineExpandDown
+	DiffLineExpandBoth
+	DiffLineExpandAll
+)
+
+// GetContextLines reads [startLine, endLine] (1-indexed, inclusive) out of
+// the blob at blobSHA and returns them as plain DiffLine entries, for
+// expanding context around a hunk produced by a JSON diff backend - those
+// backends don't embed full file content inline the way the built-in parser
+// does, so expansion has to re-read the blob on demand. direction only
+// affects how the caller chose startLine/endLine (typically capped against
+// DiffLineSectionInfo.LeftHunkSize/RightHunkSize of the neighbouring hunks);
+// it has no further effect here since the range has already been resolved.
+func GetContextLines(ctx context.Context, gitRepo *git.Repository, filePath, blobSHA string, startLine, endLine int, direction DiffLineExpandDirection) ([]*DiffLine, error) {
+	if blobSHA == "" {
+		return nil, fmt.Errorf("GetContextLines: %s has no blob SHA to expand context from", filePath)
+	}
+	if endLine < startLine {
+		return nil, fmt.Errorf("GetContextLines: endLine %d is before startLine %d", endLine, startLine)
+	}
+
+	blob, err := gitRepo.GetBlob(blobSHA)
+	if err != nil {
+		return nil, fmt.Errorf("unable to get blob %s for %s: %w", blobSHA, filePath, err)
+	}
+
+	dataRc, err := blob.DataAsync()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read blob %s for %s: %w", blobSHA, filePath, err)
+	}
+	defer dataRc.Close()
+
+	lines := make([]*DiffLine, 0, endLine-startLine+1)
+	input := bufio.NewReader(dataRc)
+	for lineNo := 1; ; lineNo++ {
+		text, err := input.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("unable to read blob %s for %s: %w", blobSHA, filePath, err)
+		}
+		if text == "" && err == io.EOF {
+			break
+		}
+		text = strings.TrimSuffix(text, "\n")
+
+		if lineNo >= startLine && lineNo <= endLine {
+			lines = append(lines, &DiffLine{
+				Type:     DiffLinePlain,
+				Content:  " " + text,
+				LeftIdx:  lineNo,
+				RightIdx: lineNo,
+				Match:    -1,
+			})
+		}
+		if lineNo >= endLine || err == io.EOF {
+			break
+		}
+	}
+
+	return lines, nil
+}
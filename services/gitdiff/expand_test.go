@@ -0,0 +1,21 @@
+package gitdiff
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestGetContextLinesRejectsMissingBlobSHA(t *testing.T) {
+	_, err := GetContextLines(context.Background(), nil, "file.txt", "", 1, 2, DiffLineExpandBoth)
+	if err == nil || !strings.Contains(err.Error(), "no blob SHA") {
+		t.Fatalf("expected a no-blob-SHA error, got %v", err)
+	}
+}
+
+func TestGetContextLinesRejectsInvertedRange(t *testing.T) {
+	_, err := GetContextLines(context.Background(), nil, "file.txt", "deadbeef", 5, 2, DiffLineExpandBoth)
+	if err == nil || !strings.Contains(err.Error(), "is before startLine") {
+		t.Fatalf("expected an inverted-range error, got %v", err)
+	}
+}
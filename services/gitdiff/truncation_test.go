@@ -0,0 +1,239 @@
+package gitdiff
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func synthesizeSpecialDiffFiles(t *testing.T, n int, linesPerFile int, lineText string) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < n; i++ {
+		lines := make([]SpecialDiffLine, 0, linesPerFile)
+		for j := 0; j < linesPerFile; j++ {
+			lines = append(lines, SpecialDiffLine{Type: "+", Text: lineText})
+		}
+		file := SpecialDiffFile{
+			Headers: []string{"diff --git a/file.txt b/file.txt"},
+			NewPath: "file.txt",
+			Status:  "modified",
+			Hunks: []SpecialDiffHunk{{
+				Headers: []string{"@@ -0,0 +1 @@"},
+				Header:  SpecialDiffHunkHeader{Raw: "@@ -0,0 +1 @@"},
+				Lines:   lines,
+			}},
+		}
+		b, err := json.Marshal(file)
+		if err != nil {
+			t.Fatalf("marshal synthetic file: %v", err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf
+}
+
+func TestParseSpecialPatchHonorsMaxFiles(t *testing.T) {
+	const totalFiles = 5000
+	input := synthesizeSpecialDiffFiles(t, totalFiles, 1, "hello")
+
+	diff, err := parseSpecialPatch(-1, -1, 10, bytes.NewReader(input.Bytes()), "")
+	if err != nil {
+		t.Fatalf("parseSpecialPatch: %v", err)
+	}
+
+	if len(diff.Files) != 10 {
+		t.Fatalf("expected 10 files, got %d", len(diff.Files))
+	}
+	if !diff.IsIncomplete {
+		t.Fatalf("expected diff.IsIncomplete to be true")
+	}
+	if diff.End == "" {
+		t.Fatalf("expected diff.End to name the file truncation stopped at")
+	}
+	if diff.NumFiles != len(diff.Files) {
+		t.Fatalf("expected diff.NumFiles to be %d, got %d", len(diff.Files), diff.NumFiles)
+	}
+	for _, f := range diff.Files {
+		if f.NameHash == "" {
+			t.Fatalf("expected file %q to have NameHash set", f.Name)
+		}
+	}
+}
+
+func TestParseSpecialPatchHonorsMaxLines(t *testing.T) {
+	input := synthesizeSpecialDiffFiles(t, 1, 5000, "hello")
+
+	diff, err := parseSpecialPatch(10, -1, -1, bytes.NewReader(input.Bytes()), "")
+	if err != nil {
+		t.Fatalf("parseSpecialPatch: %v", err)
+	}
+
+	if len(diff.Files) != 1 {
+		t.Fatalf("expected 1 file, got %d", len(diff.Files))
+	}
+	if !diff.Files[0].IsIncomplete {
+		t.Fatalf("expected file.IsIncomplete to be true")
+	}
+
+	var lineCount int
+	for _, sec := range diff.Files[0].Sections {
+		for _, l := range sec.Lines {
+			if l.Type != DiffLineSection {
+				lineCount++
+			}
+		}
+	}
+	if lineCount > 10 {
+		t.Fatalf("expected at most 10 content lines, got %d", lineCount)
+	}
+}
+
+func TestParseSpecialPatchHonorsMaxLineCharacters(t *testing.T) {
+	longText := strings.Repeat("x", 1000)
+	input := synthesizeSpecialDiffFiles(t, 1, 1, longText)
+
+	diff, err := parseSpecialPatch(-1, 100, -1, bytes.NewReader(input.Bytes()), "")
+	if err != nil {
+		t.Fatalf("parseSpecialPatch: %v", err)
+	}
+
+	foundTruncated := false
+	for _, sec := range diff.Files[0].Sections {
+		for _, l := range sec.Lines {
+			if l.Type == DiffLineAdd {
+				if len(l.Content)-1 > 100 {
+					t.Fatalf("expected content to be truncated to 100 characters, got %d", len(l.Content)-1)
+				}
+				if l.IsIncomplete {
+					foundTruncated = true
+				}
+			}
+		}
+	}
+	if !foundTruncated {
+		t.Fatalf("expected at least one line to be marked IsIncomplete")
+	}
+}
+
+func synthesizeDifftFiles(t *testing.T, n int, linesPerFile int, content string) *bytes.Buffer {
+	t.Helper()
+
+	buf := &bytes.Buffer{}
+	for i := 0; i < n; i++ {
+		chunk := make(DifftHunk, 0, linesPerFile)
+		for j := 0; j < linesPerFile; j++ {
+			chunk = append(chunk, DifftLine{
+				Rhs: DifftSide{
+					LineNumber: uint32(j + 1),
+					Changes:    []DifftChange{{Start: 0, End: uint32(len(content)), Content: content, Highlight: "novel"}},
+				},
+			})
+		}
+		file := DifftFile{
+			Path:   "file.txt",
+			Status: "modified",
+			Chunks: []DifftHunk{chunk},
+		}
+		b, err := json.Marshal(file)
+		if err != nil {
+			t.Fatalf("marshal synthetic file: %v", err)
+		}
+		buf.Write(b)
+		buf.WriteByte('\n')
+	}
+	return buf
+}
+
+func TestParseDifftPatchHonorsMaxFilesAndDrainsReader(t *testing.T) {
+	const totalFiles = 5000
+	input := synthesizeDifftFiles(t, totalFiles, 1, "hello")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		reader := bytes.NewReader(input.Bytes())
+		diff, err := parseDifftPatch(-1, -1, 25, reader, "")
+		if err != nil {
+			t.Errorf("parseDifftPatch: %v", err)
+			return
+		}
+		if reader.Len() != 0 {
+			t.Errorf("expected the reader to be drained, %d bytes left", reader.Len())
+		}
+		if len(diff.Files) != 25 {
+			t.Errorf("expected 25 files, got %d", len(diff.Files))
+		}
+		if !diff.IsIncomplete {
+			t.Errorf("expected diff.IsIncomplete to be true")
+		}
+		if diff.NumFiles != len(diff.Files) {
+			t.Errorf("expected diff.NumFiles to be %d, got %d", len(diff.Files), diff.NumFiles)
+		}
+		for _, f := range diff.Files {
+			if f.NameHash == "" {
+				t.Errorf("expected file %q to have NameHash set", f.Name)
+			}
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("parseDifftPatch did not return in time, likely blocked draining the reader")
+	}
+}
+
+func TestParseDifftPatchHonorsMaxLines(t *testing.T) {
+	input := synthesizeDifftFiles(t, 1, 5000, "hello")
+
+	diff, err := parseDifftPatch(10, -1, -1, bytes.NewReader(input.Bytes()), "")
+	if err != nil {
+		t.Fatalf("parseDifftPatch: %v", err)
+	}
+	if !diff.Files[0].IsIncomplete {
+		t.Fatalf("expected file.IsIncomplete to be true")
+	}
+}
+
+func TestParseDifftPatchHonorsMaxLinesWithPairedChanges(t *testing.T) {
+	const linesPerFile = 20
+	chunk := make(DifftHunk, 0, linesPerFile)
+	for j := 0; j < linesPerFile; j++ {
+		chunk = append(chunk, DifftLine{
+			Lhs: DifftSide{LineNumber: uint32(j + 1), Changes: []DifftChange{{Start: 0, End: 3, Content: "old", Highlight: "novel"}}},
+			Rhs: DifftSide{LineNumber: uint32(j + 1), Changes: []DifftChange{{Start: 0, End: 3, Content: "new", Highlight: "novel"}}},
+		})
+	}
+	file := DifftFile{Path: "file.txt", Status: "modified", Chunks: []DifftHunk{chunk}}
+	b, err := json.Marshal(file)
+	if err != nil {
+		t.Fatalf("marshal synthetic file: %v", err)
+	}
+	b = append(b, '\n')
+
+	const maxLines = 10
+	diff, err := parseDifftPatch(maxLines, -1, -1, bytes.NewReader(b), "")
+	if err != nil {
+		t.Fatalf("parseDifftPatch: %v", err)
+	}
+
+	var contentLines int
+	for _, sec := range diff.Files[0].Sections {
+		for _, l := range sec.Lines {
+			if l.Type != DiffLineSection {
+				contentLines++
+			}
+		}
+	}
+	if contentLines > maxLines {
+		t.Fatalf("expected at most %d DiffLines despite del+add pairing, got %d", maxLines, contentLines)
+	}
+	if !diff.Files[0].IsIncomplete {
+		t.Fatalf("expected file.IsIncomplete to be true")
+	}
+}